@@ -0,0 +1,127 @@
+// Copyright (C) 2014 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.8
+// +build go1.8
+
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// QueryContext implements driver.QueryerContext. It used to always guard
+// the statement with the watcher goroutine below; now, when conn was armed
+// via NewProgressOpsConnector/OpenDB's `_progress_ops` handling, the
+// statement is guarded by sqlite3_progress_handler (see
+// registerProgressHandler) instead, so cancellation can land between VM
+// opcodes rather than waiting for the goroutine to wake up and call
+// sqlite3_interrupt.
+func (c *SQLiteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	list := bindValuesFromNamedArgs(args)
+	if nOps, ok := connProgressOpsFor(c); ok {
+		cleanup := c.registerProgressHandler(ctx, nOps)
+		defer cleanup()
+		rows, err := c.Query(query, list)
+		if err != nil && ctx.Err() != nil {
+			// The progress handler told sqlite to abort mid-statement, so
+			// err is whatever raw SQLITE_INTERRUPT error that produced, not
+			// ctx.Err(); translate it the same way queryContextWithWatcher
+			// does for the goroutine/interrupt path below.
+			return nil, ctx.Err()
+		}
+		return rows, err
+	}
+	return c.queryContextWithWatcher(ctx, query, list)
+}
+
+// ExecContext implements driver.ExecerContext. See QueryContext for the
+// progress-handler/watcher-goroutine split.
+func (c *SQLiteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	list := bindValuesFromNamedArgs(args)
+	if nOps, ok := connProgressOpsFor(c); ok {
+		cleanup := c.registerProgressHandler(ctx, nOps)
+		defer cleanup()
+		res, err := c.Exec(query, list)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return res, err
+	}
+	return c.execContextWithWatcher(ctx, query, list)
+}
+
+// queryContextWithWatcher is the default cancellation path for connections
+// that did not opt into the progress handler: it runs the query on a
+// separate, per-statement goroutine while the calling goroutine watches ctx
+// and calls sqlite3_interrupt if it is cancelled before the query returns.
+// Cancellation latency here is bounded by the Go scheduler waking the
+// watching goroutine, not by VM opcode granularity.
+func (c *SQLiteConn) queryContextWithWatcher(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	if ctx.Done() == nil {
+		return c.Query(query, args)
+	}
+
+	type result struct {
+		rows driver.Rows
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rows, err := c.Query(query, args)
+		done <- result{rows, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.rows, r.err
+	case <-ctx.Done():
+		C.sqlite3_interrupt(c.db)
+		r := <-done
+		if r.err != nil {
+			return nil, ctx.Err()
+		}
+		return r.rows, nil
+	}
+}
+
+// execContextWithWatcher mirrors queryContextWithWatcher for Exec.
+func (c *SQLiteConn) execContextWithWatcher(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	if ctx.Done() == nil {
+		return c.Exec(query, args)
+	}
+
+	type result struct {
+		res driver.Result
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := c.Exec(query, args)
+		done <- result{res, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-ctx.Done():
+		C.sqlite3_interrupt(c.db)
+		r := <-done
+		if r.err != nil {
+			return nil, ctx.Err()
+		}
+		return r.res, nil
+	}
+}
@@ -3,6 +3,7 @@
 // Use of this source code is governed by an MIT-style
 // license that can be found in the LICENSE file.
 
+//go:build go1.8
 // +build go1.8
 
 package sqlite3
@@ -53,6 +54,192 @@ func TestNamedParams(t *testing.T) {
 	}
 }
 
+func TestNamedParamsFromStruct(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	db, err := sql.Open("sqlite3", tempFilename)
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+	create table foo (id integer, name text, extra text);
+	`)
+	if err != nil {
+		t.Error("Failed to call db.Query:", err)
+	}
+
+	type fooArgs struct {
+		ID    int    `db:"id"`
+		Name  string `db:"name"`
+		Extra string `db:"extra"`
+	}
+	type fooLookup struct {
+		ID    int    `db:"id"`
+		Extra string `db:"extra"`
+	}
+
+	// db.Exec/db.QueryRow take the struct directly: QueryContext/ExecContext
+	// expand its db-tagged fields the same way NamedArgsFromStruct does, so
+	// there is no manual sql.Named unpacking here.
+	args := fooArgs{ID: 1, Name: "foo", Extra: "foo"}
+	_, err = db.Exec(`insert into foo(id, name, extra) values(:id, :name, :extra)`, args)
+	if err != nil {
+		t.Error("Failed to call db.Exec:", err)
+	}
+
+	row := db.QueryRow(`select id, extra from foo where id = :id and extra = :extra`, fooLookup{ID: 1, Extra: "foo"})
+	var id int
+	var extra string
+	if err := row.Scan(&id, &extra); err != nil {
+		t.Error("Failed to db.Scan:", err)
+	}
+	if id != 1 || extra != "foo" {
+		t.Error("Failed to db.QueryRow: not matched results")
+	}
+}
+
+func namedArg(t *testing.T, args []sql.NamedArg, name string) interface{} {
+	t.Helper()
+	for _, a := range args {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	t.Fatalf("no %q argument in %v", name, args)
+	return nil
+}
+
+func TestNamedArgsFromStruct(t *testing.T) {
+	type Base struct {
+		ID int `db:"id"`
+	}
+	type Detail struct {
+		Extra string `db:"extra"`
+	}
+	type withEmbeds struct {
+		Base
+		*Detail
+		Name     string    `db:"name"`
+		Nickname *string   `db:"nickname"`
+		When     time.Time `db:"when"`
+		Hidden   string    `db:"-"`
+		unexp    string
+	}
+
+	when := time.Date(2026, 7, 30, 12, 0, 0, 0, time.UTC)
+	v := withEmbeds{
+		Base:     Base{ID: 1},
+		Detail:   &Detail{Extra: "foo"},
+		Name:     "bar",
+		Nickname: nil,
+		When:     when,
+		Hidden:   "should not appear",
+		unexp:    "should not appear",
+	}
+
+	args := NamedArgsFromStruct(v)
+	if got := namedArg(t, args, "id"); got != 1 {
+		t.Errorf("id: got %v, want 1", got)
+	}
+	if got := namedArg(t, args, "extra"); got != "foo" {
+		t.Errorf("extra: got %v, want foo", got)
+	}
+	if got := namedArg(t, args, "name"); got != "bar" {
+		t.Errorf("name: got %v, want bar", got)
+	}
+	if got := namedArg(t, args, "nickname"); got != nil {
+		t.Errorf("nickname: got %v, want nil", got)
+	}
+	if got, ok := namedArg(t, args, "when").(time.Time); !ok || !got.Equal(when) {
+		t.Errorf("when: got %v, want %v", got, when)
+	}
+	for _, a := range args {
+		if a.Name == "hidden" || a.Name == "unexp" {
+			t.Errorf("NamedArgsFromStruct should not bind %q", a.Name)
+		}
+	}
+
+	// A nil anonymous pointer embed has no fields to promote, so its
+	// tagged fields bind NULL rather than panicking on the nil dereference.
+	nilDetail := withEmbeds{Base: Base{ID: 2}, Name: "baz", When: when}
+	args = NamedArgsFromStruct(nilDetail)
+	if got := namedArg(t, args, "extra"); got != nil {
+		t.Errorf("extra with nil *Detail: got %v, want nil", got)
+	}
+
+	mapArgs := NamedArgsFromStruct(map[string]interface{}{"id": 3})
+	if got := namedArg(t, mapArgs, "id"); got != 3 {
+		t.Errorf("map id: got %v, want 3", got)
+	}
+}
+
+func TestNamedParamsFromStructEmbeddedAndTime(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	db, err := sql.Open("sqlite3", tempFilename+"?_loc=UTC&_time_format=sqlite")
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+	create table events (id integer, name text, note text, happened_at timestamp);
+	`)
+	if err != nil {
+		t.Fatal("Failed to create table:", err)
+	}
+
+	type meta struct {
+		Note string `db:"note"`
+	}
+	type event struct {
+		ID int `db:"id"`
+		*meta
+		Name       string    `db:"name"`
+		HappenedAt time.Time `db:"happened_at"`
+	}
+
+	when := time.Date(2026, 7, 30, 12, 0, 0, 0, time.UTC)
+
+	// A nil anonymous pointer embed (*meta) binds its tagged fields as NULL
+	// instead of panicking on the nil dereference.
+	_, err = db.Exec(`insert into events(id, name, note, happened_at) values(:id, :name, :note, :happened_at)`,
+		event{ID: 1, Name: "first", HappenedAt: when})
+	if err != nil {
+		t.Fatal("Failed to insert with nil embed:", err)
+	}
+
+	_, err = db.Exec(`insert into events(id, name, note, happened_at) values(:id, :name, :note, :happened_at)`,
+		event{ID: 2, meta: &meta{Note: "annotated"}, Name: "second", HappenedAt: when})
+	if err != nil {
+		t.Fatal("Failed to insert with populated embed:", err)
+	}
+
+	var note sql.NullString
+	var happenedAt time.Time
+	if err := db.QueryRow(`select note, happened_at from events where id = 1`).Scan(&note, &happenedAt); err != nil {
+		t.Fatal("Failed to scan id=1:", err)
+	}
+	if note.Valid {
+		t.Errorf("id=1 note: got %q, want NULL", note.String)
+	}
+	if !happenedAt.Equal(when) {
+		t.Errorf("id=1 happened_at: got %v, want %v", happenedAt, when)
+	}
+
+	if err := db.QueryRow(`select note, happened_at from events where id = 2`).Scan(&note, &happenedAt); err != nil {
+		t.Fatal("Failed to scan id=2:", err)
+	}
+	if !note.Valid || note.String != "annotated" {
+		t.Errorf("id=2 note: got %v, want annotated", note)
+	}
+	if !happenedAt.Equal(when) {
+		t.Errorf("id=2 happened_at: got %v, want %v", happenedAt, when)
+	}
+}
+
 var (
 	testTableStatements = []string{
 		`DROP TABLE IF EXISTS test_table`,
@@ -85,7 +272,7 @@ func randStringBytes(n int) string {
 	return string(b)
 }
 
-func initDatabase(t *testing.T, db *sql.DB, rowCount int64) {
+func initDatabase(t testing.TB, db *sql.DB, rowCount int64) {
 	t.Logf("Executing db initializing statements")
 	for _, query := range testTableStatements {
 		_, err := db.Exec(query)
@@ -127,7 +314,7 @@ func initDatabase(t *testing.T, db *sql.DB, rowCount int64) {
 	}
 }
 
-func runQueryContext(t *testing.T, db *sql.DB, timeout time.Duration) error {
+func runQueryContext(t testing.TB, db *sql.DB, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	query := "SELECT key1, key_id, key2, key3, key4, key5, key6, data FROM test_table"
@@ -156,7 +343,7 @@ func runQueryContext(t *testing.T, db *sql.DB, timeout time.Duration) error {
 	return nil
 }
 
-func getMaxTimeout(t *testing.T, db *sql.DB) int64 {
+func getMaxTimeout(t testing.TB, db *sql.DB) int64 {
 	nilCount := 0
 	errCount := 0
 	for i := 1; i <= 60; i++ {
@@ -197,3 +384,53 @@ func TestQueryContext(t *testing.T) {
 		}
 	}
 }
+
+// benchmarkCancellationLatency drives the same random-timeout workload as
+// TestQueryContext and reports the mean wall-clock time between a context
+// deadline firing and runQueryContext observing it, so the goroutine+
+// sqlite3_interrupt path and the sqlite3_progress_handler path (opted into
+// via the `_progress_ops` DSN parameter, through OpenDB) can be compared
+// directly.
+func benchmarkCancellationLatency(b *testing.B, address string) {
+	db, err := OpenDB(address)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	initDatabase(b, db, rowCount)
+	maxTimeout := getMaxTimeout(b, db)
+
+	b.ResetTimer()
+	var totalOverrun time.Duration
+	cancels := 0
+	for i := 0; i < b.N; i++ {
+		timeout := time.Duration(rand.Int63n(maxTimeout)) * time.Nanosecond
+		start := time.Now()
+		err := runQueryContext(b, db, timeout)
+		if err != nil && err != context.DeadlineExceeded {
+			b.Fatal(err)
+		}
+		if err == context.DeadlineExceeded {
+			totalOverrun += time.Since(start) - timeout
+			cancels++
+		}
+	}
+	b.StopTimer()
+	if cancels > 0 {
+		b.ReportMetric(float64(totalOverrun.Nanoseconds())/float64(cancels), "ns/cancel-overrun")
+	}
+}
+
+// BenchmarkCancellationLatencyGoroutine exercises the default cancellation
+// path, where each statement runs on its own goroutine and the calling
+// goroutine calls sqlite3_interrupt after observing ctx.Done().
+func BenchmarkCancellationLatencyGoroutine(b *testing.B) {
+	benchmarkCancellationLatency(b, sqliteAddress)
+}
+
+// BenchmarkCancellationLatencyProgressHandler exercises the opt-in
+// sqlite3_progress_handler path, which aborts a running statement between VM
+// opcodes instead of waiting for the watcher goroutine to wake up.
+func BenchmarkCancellationLatencyProgressHandler(b *testing.B) {
+	benchmarkCancellationLatency(b, sqliteAddress+"&_progress_ops=200")
+}
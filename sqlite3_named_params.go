@@ -0,0 +1,218 @@
+// Copyright (C) 2014 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite3
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// namedFieldsCache memoizes the []namedField layout for a struct type so
+// repeated Exec/Query calls in a hot loop don't re-walk the same type with
+// reflection every time.
+var namedFieldsCache sync.Map // map[reflect.Type][]namedField
+
+type namedField struct {
+	index []int
+	name  string
+}
+
+// NamedArgsFromStruct builds a []sql.NamedArg from v, a struct (or pointer
+// to struct) whose exported fields carry a `db:"name"` tag, or a
+// map[string]any. Callers rarely need to invoke it directly: QueryContext
+// and ExecContext already recognize a lone struct or map[string]any
+// argument and expand it the same way, so
+//
+//	db.Exec(query, args)
+//
+// binds every tagged field of args without unpacking them into individual
+// sql.Named calls. NamedArgsFromStruct remains exported for callers who want
+// to build the []sql.NamedArg themselves, e.g. to merge it with other
+// arguments. Fields tagged `db:"-"` are skipped. Anonymous struct fields are
+// flattened as if their tagged fields were promoted to the outer struct. A
+// nil pointer field is bound as NULL rather than dereferenced.
+func NamedArgsFromStruct(v any) []sql.NamedArg {
+	if m, ok := v.(map[string]interface{}); ok {
+		args := make([]sql.NamedArg, 0, len(m))
+		for name, val := range m {
+			args = append(args, sql.Named(name, val))
+		}
+		return args
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("sqlite3: NamedArgsFromStruct: unsupported type %T", v))
+	}
+
+	fields := namedFieldsOf(rv.Type())
+	args := make([]sql.NamedArg, 0, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok {
+			// A nil anonymous pointer embed along the path: there is no
+			// value to promote, so bind NULL rather than dereferencing it.
+			args = append(args, sql.Named(f.name, nil))
+			continue
+		}
+		if fv.Kind() == reflect.Ptr && fv.IsNil() {
+			args = append(args, sql.Named(f.name, nil))
+			continue
+		}
+		args = append(args, sql.Named(f.name, fv.Interface()))
+	}
+	return args
+}
+
+// fieldByIndex walks index the same way reflect.Value.FieldByIndex does, but
+// stops and reports ok == false instead of panicking when it has to
+// dereference a nil pointer to reach an embedded struct.
+func fieldByIndex(v reflect.Value, index []int) (fv reflect.Value, ok bool) {
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+// namedFieldsOf returns the db-tagged fields of t, descending into anonymous
+// struct fields, and caches the result keyed by reflect.Type.
+func namedFieldsOf(t reflect.Type) []namedField {
+	if cached, ok := namedFieldsCache.Load(t); ok {
+		return cached.([]namedField)
+	}
+
+	var fields []namedField
+	var walk func(t reflect.Type, prefix []int)
+	walk = func(t reflect.Type, prefix []int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" && !sf.Anonymous {
+				// Unexported, non-embedded: reflection cannot read it.
+				continue
+			}
+			index := append(append([]int{}, prefix...), i)
+			if sf.Anonymous {
+				ft := sf.Type
+				for ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					// Exported fields promoted through an embed stay
+					// readable even when the embedded type is unexported.
+					walk(ft, index)
+					continue
+				}
+			}
+			if sf.PkgPath != "" {
+				// An embed of an unexported non-struct type: it has no
+				// fields to promote and cannot be read itself.
+				continue
+			}
+			tag, ok := sf.Tag.Lookup("db")
+			if !ok || tag == "-" {
+				continue
+			}
+			fields = append(fields, namedField{index: index, name: tag})
+		}
+	}
+	walk(t, nil)
+
+	namedFieldsCache.Store(t, fields)
+	return fields
+}
+
+// CheckNamedValue implements driver.NamedValueChecker. database/sql calls it
+// for every argument before ExecContext/QueryContext ever see them; without
+// it, driver.DefaultParameterConverter.ConvertValue would reject a struct
+// argument with an "unsupported type ..., a struct" error before
+// expandSingleStructArg got a chance to expand it. A struct or
+// map[string]any is accepted as-is, to be expanded later by
+// bindValuesFromNamedArgs; every other value defers to the default checks
+// via driver.ErrSkip.
+func (c *SQLiteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if isExpandableArg(nv.Value) {
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+// bindValuesFromNamedArgs converts args, as QueryContext/ExecContext receive
+// them from database/sql, into the []driver.Value the statement-level bind
+// loop expects. A lone struct or map[string]any argument is first expanded
+// via NamedArgsFromStruct, so `db.Exec(query, args)` with a single tagged
+// struct binds every field by name. Every named value, whether it arrived as
+// an explicit sql.Named call or came from the struct expansion, is re-boxed
+// as sql.NamedArg so the bind loop binds it by :name/@name/$name instead of
+// positionally.
+func bindValuesFromNamedArgs(args []driver.NamedValue) []driver.Value {
+	args = expandSingleStructArg(args)
+	list := make([]driver.Value, len(args))
+	for i, nv := range args {
+		if nv.Name != "" {
+			list[i] = sql.Named(nv.Name, nv.Value)
+			continue
+		}
+		list[i] = nv.Value
+	}
+	return list
+}
+
+// expandSingleStructArg recognizes the `db.Exec(query, args)` shape: exactly
+// one positional argument whose value is a struct (or map[string]any)
+// rather than a scalar, []byte, time.Time, or driver.Valuer. When it
+// matches, it replaces args with the NamedArgsFromStruct expansion; any
+// other shape, including multiple arguments or a single scalar/named
+// argument, passes through unchanged.
+func expandSingleStructArg(args []driver.NamedValue) []driver.NamedValue {
+	if len(args) != 1 || args[0].Name != "" || !isExpandableArg(args[0].Value) {
+		return args
+	}
+	named := NamedArgsFromStruct(args[0].Value)
+	expanded := make([]driver.NamedValue, len(named))
+	for i, na := range named {
+		expanded[i] = driver.NamedValue{Ordinal: i + 1, Name: na.Name, Value: na.Value}
+	}
+	return expanded
+}
+
+// isExpandableArg reports whether v is a struct or map[string]any that
+// NamedArgsFromStruct can expand, as opposed to a scalar database/sql/driver
+// already knows how to bind directly.
+func isExpandableArg(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	switch v.(type) {
+	case int64, float64, bool, []byte, string, time.Time, driver.Valuer:
+		return false
+	case map[string]interface{}:
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return false
+		}
+		rv = rv.Elem()
+	}
+	return rv.Kind() == reflect.Struct && rv.Type() != reflect.TypeOf(time.Time{})
+}
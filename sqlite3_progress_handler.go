@@ -0,0 +1,152 @@
+// Copyright (C) 2014 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.8
+// +build go1.8
+
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdlib.h>
+
+int progressHandlerTrampoline(void *pArg);
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// defaultProgressOps is the number of SQLite virtual machine instructions
+// between successive invocations of the progress handler when the DSN
+// carries `_progress_ops` without a value.
+const defaultProgressOps = 1000
+
+// progressHandler is the Go-side state consulted by progressHandlerTrampoline
+// on every invocation from sqlite3_progress_handler.
+type progressHandler struct {
+	ctx context.Context
+}
+
+// progressHandlers maps the small integer handed to C as the
+// sqlite3_progress_handler pArg back to the *progressHandler it identifies.
+// It is a dedicated registry, separate from the *SQLiteConn-keyed handle
+// registry used elsewhere in the package, for the same reason vfsHandles is:
+// a statement's progress handler is not the only Go callback state a
+// connection may own, so tearing it down through deleteHandles(conn) would
+// also delete any unrelated handle (e.g. a registered SQL function) that
+// happens to be keyed on the same *SQLiteConn.
+var (
+	progressHandlersMu sync.Mutex
+	progressHandlers   = make(map[uint64]*progressHandler)
+	progressHandlerSeq uint64
+)
+
+func newProgressHandlerHandle(h *progressHandler) uint64 {
+	progressHandlersMu.Lock()
+	defer progressHandlersMu.Unlock()
+	progressHandlerSeq++
+	id := progressHandlerSeq
+	progressHandlers[id] = h
+	return id
+}
+
+func deleteProgressHandlerHandle(id uint64) {
+	progressHandlersMu.Lock()
+	defer progressHandlersMu.Unlock()
+	delete(progressHandlers, id)
+}
+
+//export progressHandlerTrampoline
+func progressHandlerTrampoline(pArg unsafe.Pointer) C.int {
+	progressHandlersMu.Lock()
+	h, ok := progressHandlers[uint64(uintptr(pArg))]
+	progressHandlersMu.Unlock()
+	if !ok {
+		return 0
+	}
+	select {
+	case <-h.ctx.Done():
+		return 1
+	default:
+		return 0
+	}
+}
+
+// registerProgressHandler installs sqlite3_progress_handler on conn, calling
+// back into Go every nOps VM opcodes. It replaces any progress handler
+// previously installed on conn, whatever ctx that handler served; the
+// returned cleanup function unregisters
+// it and must be called once the statement it guards has finished, whether
+// or not the context was ever cancelled.
+func (c *SQLiteConn) registerProgressHandler(ctx context.Context, nOps int) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if nOps <= 0 {
+		nOps = defaultProgressOps
+	}
+	id := newProgressHandlerHandle(&progressHandler{ctx: ctx})
+	C.sqlite3_progress_handler(c.db, C.int(nOps), (*[0]byte)(C.progressHandlerTrampoline), unsafe.Pointer(uintptr(id)))
+	return func() {
+		C.sqlite3_progress_handler(c.db, 0, nil, nil)
+		deleteProgressHandlerHandle(id)
+	}
+}
+
+// parseProgressOps reads the `_progress_ops` DSN parameter. It returns
+// ok == false when the parameter is absent, in which case callers must fall
+// back to the per-statement interrupt goroutine instead of the progress
+// handler.
+func parseProgressOps(params map[string][]string) (nOps int, ok bool, err error) {
+	v, present := params["_progress_ops"]
+	if !present || len(v) == 0 {
+		return 0, false, nil
+	}
+	if v[0] == "" {
+		return defaultProgressOps, true, nil
+	}
+	nOps, err = strconv.Atoi(v[0])
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid _progress_ops: %v: %v", v[0], err)
+	}
+	return nOps, true, nil
+}
+
+// connProgressOps records, per *SQLiteConn, the tick rate a connection
+// opted into via `_progress_ops` (set up by NewProgressOpsConnector or
+// OpenDB). QueryContext/ExecContext consult it to decide whether a given
+// statement should be guarded by registerProgressHandler instead of the
+// default watcher goroutine.
+var connProgressOps sync.Map // map[*SQLiteConn]int
+
+// setConnProgressOps arms conn to use the progress-handler cancellation path
+// for every statement it runs, at the given VM-opcode tick rate.
+func setConnProgressOps(conn *SQLiteConn, nOps int) {
+	connProgressOps.Store(conn, nOps)
+}
+
+// connProgressOpsFor reports the tick rate conn was armed with, if any.
+func connProgressOpsFor(conn *SQLiteConn) (nOps int, ok bool) {
+	v, ok := connProgressOps.Load(conn)
+	if !ok {
+		return 0, false
+	}
+	return v.(int), true
+}
+
+// clearConnProgressOps forgets conn's opt-in, called from its Close.
+func clearConnProgressOps(conn *SQLiteConn) {
+	connProgressOps.Delete(conn)
+}
@@ -0,0 +1,418 @@
+// Copyright (C) 2014 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdlib.h>
+#include "vfs_shim.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// OpenFlag mirrors the subset of SQLITE_OPEN_* flags that are meaningful to
+// a VFS implementation's Open method.
+type OpenFlag int
+
+const (
+	OpenReadOnly    OpenFlag = C.SQLITE_OPEN_READONLY
+	OpenReadWrite   OpenFlag = C.SQLITE_OPEN_READWRITE
+	OpenCreate      OpenFlag = C.SQLITE_OPEN_CREATE
+	OpenMainDB      OpenFlag = C.SQLITE_OPEN_MAIN_DB
+	OpenMainJournal OpenFlag = C.SQLITE_OPEN_MAIN_JOURNAL
+	OpenWalJournal  OpenFlag = C.SQLITE_OPEN_WAL
+)
+
+// LockLevel mirrors the SQLITE_LOCK_* constants passed to File.Lock and
+// File.Unlock.
+type LockLevel int
+
+const (
+	LockNone      LockLevel = C.SQLITE_LOCK_NONE
+	LockShared    LockLevel = C.SQLITE_LOCK_SHARED
+	LockReserved  LockLevel = C.SQLITE_LOCK_RESERVED
+	LockPending   LockLevel = C.SQLITE_LOCK_PENDING
+	LockExclusive LockLevel = C.SQLITE_LOCK_EXCLUSIVE
+)
+
+// File is the interface a Go-implemented VFS must satisfy for every handle
+// it hands back from VFS.Open. It covers the xRead/xWrite/xTruncate/xSync/
+// xFileSize/xLock/xUnlock/xCheckReservedLock/xSectorSize/
+// xDeviceCharacteristics methods of sqlite3_io_methods.
+type File interface {
+	ReadAt(p []byte, off int64) (n int, err error)
+	WriteAt(p []byte, off int64) (n int, err error)
+	Truncate(size int64) error
+	Sync() error
+	FileSize() (int64, error)
+	Lock(level LockLevel) error
+	Unlock(level LockLevel) error
+	CheckReservedLock() (bool, error)
+	SectorSize() int
+	DeviceCharacteristics() int
+	Close() error
+}
+
+// VFS is the interface a Go package implements to be registered with
+// RegisterVFS. It covers the xOpen/xDelete/xAccess/xFullPathname/
+// xCurrentTime methods of sqlite3_vfs; everything below the file level is handled by the
+// File interface returned from Open.
+type VFS interface {
+	Open(name string, flags OpenFlag) (File, error)
+	Delete(name string, syncDir bool) error
+	Access(name string, flags OpenFlag) (bool, error)
+	FullPathname(name string) (string, error)
+	CurrentTime() time.Time
+}
+
+var (
+	vfsRegistryMu sync.Mutex
+	vfsRegistry   = make(map[string]*registeredVFS)
+)
+
+// vfsHandles maps the small integer handed to C as sqlite3_vfs.pAppData back
+// to the *registeredVFS it identifies. It is a dedicated registry, separate
+// from the *SQLiteConn-keyed one used elsewhere in the package, because a
+// registered VFS is not owned by any single connection: reusing the shared
+// registry with a nil conn key would make every VFS registration collide on
+// the same key, so freeing one VFS's handle would delete every other VFS's
+// handle too.
+var (
+	vfsHandlesMu sync.Mutex
+	vfsHandles   = make(map[int]*registeredVFS)
+	vfsHandleSeq int
+)
+
+func newVFSHandle(rv *registeredVFS) int {
+	vfsHandlesMu.Lock()
+	defer vfsHandlesMu.Unlock()
+	vfsHandleSeq++
+	h := vfsHandleSeq
+	vfsHandles[h] = rv
+	return h
+}
+
+func deleteVFSHandle(handle int) {
+	vfsHandlesMu.Lock()
+	defer vfsHandlesMu.Unlock()
+	delete(vfsHandles, handle)
+}
+
+// registeredVFS pairs a Go VFS implementation with the C sqlite3_vfs vtable
+// that forwards cgo callbacks into it, and the open Go Files keyed by the
+// handle stashed in sqlite3_file.pMethods-adjacent storage.
+type registeredVFS struct {
+	impl    VFS
+	cVFS    *C.sqlite3_vfs
+	cName   *C.char
+	handle  int
+	filesMu sync.Mutex
+	files   map[int]File
+	retired bool // set once a later RegisterVFS call has replaced rv
+}
+
+// retire unregisters rv's name from sqlite, so no new connection can look it
+// up by name, but does not yet free its C-side state: a pager belonging to
+// an already-open connection keeps its own pointer to rv.cVFS and will keep
+// calling xOpen/xAccess/xFullPathname/xCurrentTime (and xRead/xWrite/...
+// on any sqlite3_file it still has open) directly through it regardless of
+// sqlite3_vfs_unregister. Freeing cVFS here would leave those calls
+// dereferencing freed memory, and vfsByHandle would panic the moment one of
+// them reached Go. The C-side state is only actually released, by release,
+// once rv.files drops to zero — which happens once every connection that
+// was using rv has closed its last file, since the main db file stays open
+// for a connection's entire lifetime. Callers must hold vfsRegistryMu.
+func (rv *registeredVFS) retire() {
+	C.sqlite3_vfs_unregister(rv.cVFS)
+	rv.filesMu.Lock()
+	rv.retired = true
+	idle := len(rv.files) == 0
+	rv.filesMu.Unlock()
+	if idle {
+		rv.release()
+	}
+}
+
+// release frees rv's cVFS allocation and zName C string, and removes its
+// entry from vfsHandles. Callers must ensure rv is retired and has no
+// Files left open.
+func (rv *registeredVFS) release() {
+	C.goSqlite3VFSFree(rv.cVFS)
+	C.free(unsafe.Pointer(rv.cName))
+	deleteVFSHandle(rv.handle)
+}
+
+// RegisterVFS makes vfs available to SQLite connections opened with a DSN
+// of the form `file:foo.db?vfs=name`. Registration is permanent for the
+// lifetime of the process, mirroring sql.Register; calling it twice with
+// the same name replaces the previous registration.
+func RegisterVFS(name string, vfs VFS) error {
+	if name == "" {
+		return errors.New("sqlite3: VFS name must not be empty")
+	}
+	if vfs == nil {
+		return errors.New("sqlite3: VFS implementation must not be nil")
+	}
+
+	vfsRegistryMu.Lock()
+	defer vfsRegistryMu.Unlock()
+
+	rv := &registeredVFS{
+		impl:  vfs,
+		files: make(map[int]File),
+	}
+	rv.handle = newVFSHandle(rv)
+
+	cName := C.CString(name)
+	cVFS := C.goSqlite3VFSNew(cName, C.uintptr_t(rv.handle))
+	if cVFS == nil {
+		C.free(unsafe.Pointer(cName))
+		deleteVFSHandle(rv.handle)
+		return fmt.Errorf("sqlite3: failed to allocate sqlite3_vfs %q", name)
+	}
+	rv.cVFS = cVFS
+	rv.cName = cName
+
+	if rc := C.sqlite3_vfs_register(cVFS, 0); rc != C.SQLITE_OK {
+		C.free(unsafe.Pointer(cName))
+		C.goSqlite3VFSFree(cVFS)
+		deleteVFSHandle(rv.handle)
+		return fmt.Errorf("sqlite3: sqlite3_vfs_register(%q) failed: %d", name, rc)
+	}
+
+	// A second RegisterVFS call for the same name replaces the previous
+	// registration; retire its C-side state now that the new one has been
+	// installed successfully, otherwise the old sqlite3_vfs, its zName
+	// string, and its vfsHandles entry leak for the life of the process.
+	// retire defers the actual free until connections still using the old
+	// VFS have closed (see retire's doc comment).
+	if old, ok := vfsRegistry[name]; ok {
+		old.retire()
+	}
+
+	vfsRegistry[name] = rv
+	return nil
+}
+
+func vfsByHandle(handle C.uintptr_t) *registeredVFS {
+	vfsHandlesMu.Lock()
+	defer vfsHandlesMu.Unlock()
+	rv := vfsHandles[int(handle)]
+	if rv == nil {
+		panic(fmt.Sprintf("sqlite3: invalid VFS handle %d", handle))
+	}
+	return rv
+}
+
+func vfsFileByHandle(rv *registeredVFS, fileHandle C.int) File {
+	rv.filesMu.Lock()
+	defer rv.filesMu.Unlock()
+	return rv.files[int(fileHandle)]
+}
+
+//export goVFSOpen
+func goVFSOpen(vfsHandle C.uintptr_t, cName *C.char, flags C.int, outErr **C.char) C.int {
+	rv := vfsByHandle(vfsHandle)
+	name := C.GoString(cName)
+	f, err := rv.impl.Open(name, OpenFlag(flags))
+	if err != nil {
+		*outErr = C.CString(err.Error())
+		return -1
+	}
+	rv.filesMu.Lock()
+	fh := len(rv.files)
+	for _, ok := rv.files[fh]; ok; _, ok = rv.files[fh] {
+		fh++
+	}
+	rv.files[fh] = f
+	rv.filesMu.Unlock()
+	return C.int(fh)
+}
+
+//export goVFSClose
+func goVFSClose(vfsHandle C.uintptr_t, fileHandle C.int) C.int {
+	rv := vfsByHandle(vfsHandle)
+	rv.filesMu.Lock()
+	f := rv.files[int(fileHandle)]
+	delete(rv.files, int(fileHandle))
+	idle := rv.retired && len(rv.files) == 0
+	rv.filesMu.Unlock()
+	if idle {
+		// The last File of a retired (replaced) VFS just closed: nothing
+		// still holds a pointer to rv.cVFS, so it is now safe to free.
+		rv.release()
+	}
+	if f == nil {
+		return C.SQLITE_IOERR_CLOSE
+	}
+	if err := f.Close(); err != nil {
+		return C.SQLITE_IOERR_CLOSE
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSRead
+func goVFSRead(vfsHandle C.uintptr_t, fileHandle C.int, buf unsafe.Pointer, n C.int, off C.int64_t) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	p := unsafe.Slice((*byte)(buf), int(n))
+	read, err := f.ReadAt(p, int64(off))
+	if read < int(n) {
+		for i := read; i < int(n); i++ {
+			p[i] = 0
+		}
+		if err == nil {
+			return C.SQLITE_IOERR_SHORT_READ
+		}
+	}
+	if err != nil {
+		return C.SQLITE_IOERR_READ
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSWrite
+func goVFSWrite(vfsHandle C.uintptr_t, fileHandle C.int, buf unsafe.Pointer, n C.int, off C.int64_t) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	p := unsafe.Slice((*byte)(buf), int(n))
+	if _, err := f.WriteAt(p, int64(off)); err != nil {
+		return C.SQLITE_IOERR_WRITE
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSTruncate
+func goVFSTruncate(vfsHandle C.uintptr_t, fileHandle C.int, size C.int64_t) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	if err := f.Truncate(int64(size)); err != nil {
+		return C.SQLITE_IOERR_TRUNCATE
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSSync
+func goVFSSync(vfsHandle C.uintptr_t, fileHandle C.int, flags C.int) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	if err := f.Sync(); err != nil {
+		return C.SQLITE_IOERR_FSYNC
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSFileSize
+func goVFSFileSize(vfsHandle C.uintptr_t, fileHandle C.int, outSize *C.int64_t) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	size, err := f.FileSize()
+	if err != nil {
+		return C.SQLITE_IOERR_FSTAT
+	}
+	*outSize = C.int64_t(size)
+	return C.SQLITE_OK
+}
+
+//export goVFSLock
+func goVFSLock(vfsHandle C.uintptr_t, fileHandle C.int, level C.int) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	if err := f.Lock(LockLevel(level)); err != nil {
+		return C.SQLITE_BUSY
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSUnlock
+func goVFSUnlock(vfsHandle C.uintptr_t, fileHandle C.int, level C.int) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	if err := f.Unlock(LockLevel(level)); err != nil {
+		return C.SQLITE_IOERR_UNLOCK
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSCheckReservedLock
+func goVFSCheckReservedLock(vfsHandle C.uintptr_t, fileHandle C.int, outReserved *C.int) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	reserved, err := f.CheckReservedLock()
+	if err != nil {
+		return C.SQLITE_IOERR_CHECKRESERVEDLOCK
+	}
+	if reserved {
+		*outReserved = 1
+	} else {
+		*outReserved = 0
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSSectorSize
+func goVFSSectorSize(vfsHandle C.uintptr_t, fileHandle C.int) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	return C.int(f.SectorSize())
+}
+
+//export goVFSDeviceCharacteristics
+func goVFSDeviceCharacteristics(vfsHandle C.uintptr_t, fileHandle C.int) C.int {
+	f := vfsFileByHandle(vfsByHandle(vfsHandle), fileHandle)
+	return C.int(f.DeviceCharacteristics())
+}
+
+//export goVFSAccess
+func goVFSAccess(vfsHandle C.uintptr_t, cName *C.char, flags C.int, outOK *C.int) C.int {
+	rv := vfsByHandle(vfsHandle)
+	ok, err := rv.impl.Access(C.GoString(cName), OpenFlag(flags))
+	if err != nil {
+		return C.SQLITE_IOERR_ACCESS
+	}
+	if ok {
+		*outOK = 1
+	} else {
+		*outOK = 0
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSDelete
+func goVFSDelete(vfsHandle C.uintptr_t, cName *C.char, syncDir C.int) C.int {
+	rv := vfsByHandle(vfsHandle)
+	if err := rv.impl.Delete(C.GoString(cName), syncDir != 0); err != nil {
+		return C.SQLITE_IOERR_DELETE
+	}
+	return C.SQLITE_OK
+}
+
+//export goVFSFullPathname
+func goVFSFullPathname(vfsHandle C.uintptr_t, cName *C.char, outBuf *C.char, outBufLen C.int) C.int {
+	rv := vfsByHandle(vfsHandle)
+	full, err := rv.impl.FullPathname(C.GoString(cName))
+	if err != nil {
+		return C.SQLITE_ERROR
+	}
+	if len(full)+1 > int(outBufLen) {
+		return C.SQLITE_CANTOPEN
+	}
+	cFull := C.CString(full)
+	defer C.free(unsafe.Pointer(cFull))
+	C.memcpy(unsafe.Pointer(outBuf), unsafe.Pointer(cFull), C.size_t(len(full)+1))
+	return C.SQLITE_OK
+}
+
+//export goVFSCurrentTime
+func goVFSCurrentTime(vfsHandle C.uintptr_t, outJulian *C.double) {
+	rv := vfsByHandle(vfsHandle)
+	t := rv.impl.CurrentTime()
+	// Convert to a Julian day number, matching sqlite3's own xCurrentTime.
+	const unixEpochJulianDay = 2440587.5
+	*outJulian = C.double(unixEpochJulianDay + float64(t.UnixNano())/8.64e13)
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2014 Yasuhiro Matsumoto <mattn.jp@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// passthroughVFS is a minimal VFS that opens every file directly beneath
+// dir using the OS filesystem. It exists to give RegisterVFS a conformance
+// test: if a Go-implemented VFS that merely forwards to *os.File can run
+// the same test_table workload as the built-in unix/win32 VFS, the cgo
+// plumbing between sqlite3_vfs/sqlite3_io_methods and the Go VFS/File
+// interfaces is wired correctly end to end.
+type passthroughVFS struct {
+	dir string
+}
+
+type passthroughFile struct {
+	f *os.File
+}
+
+func (v *passthroughVFS) resolve(name string) string {
+	if name == "" {
+		return filepath.Join(v.dir, fmt.Sprintf("unnamed-%d", time.Now().UnixNano()))
+	}
+	return filepath.Join(v.dir, filepath.Base(name))
+}
+
+func (v *passthroughVFS) Open(name string, flags OpenFlag) (File, error) {
+	osFlags := os.O_RDWR
+	if flags&OpenCreate != 0 {
+		osFlags |= os.O_CREATE
+	}
+	if flags&OpenReadWrite == 0 {
+		osFlags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(v.resolve(name), osFlags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &passthroughFile{f: f}, nil
+}
+
+func (v *passthroughVFS) Delete(name string, syncDir bool) error {
+	err := os.Remove(v.resolve(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (v *passthroughVFS) Access(name string, flags OpenFlag) (bool, error) {
+	_, err := os.Stat(v.resolve(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (v *passthroughVFS) FullPathname(name string) (string, error) {
+	return v.resolve(name), nil
+}
+
+func (v *passthroughVFS) CurrentTime() time.Time {
+	return time.Now()
+}
+
+func (f *passthroughFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(p, off)
+	if err != nil && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *passthroughFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.f.WriteAt(p, off)
+}
+
+func (f *passthroughFile) Truncate(size int64) error {
+	return f.f.Truncate(size)
+}
+
+func (f *passthroughFile) Sync() error {
+	return f.f.Sync()
+}
+
+func (f *passthroughFile) FileSize() (int64, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (f *passthroughFile) Lock(level LockLevel) error {
+	return nil
+}
+
+func (f *passthroughFile) Unlock(level LockLevel) error {
+	return nil
+}
+
+func (f *passthroughFile) CheckReservedLock() (bool, error) {
+	return false, nil
+}
+
+func (f *passthroughFile) SectorSize() int {
+	return 4096
+}
+
+func (f *passthroughFile) DeviceCharacteristics() int {
+	return 0
+}
+
+func (f *passthroughFile) Close() error {
+	return f.f.Close()
+}
+
+func TestRegisterVFSPassthrough(t *testing.T) {
+	dir := t.TempDir()
+	if err := RegisterVFS("passthrough_test", &passthroughVFS{dir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:test.db?vfs=passthrough_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	initDatabase(t, db, 100)
+
+	rows, err := db.Query("SELECT key1, key_id, key2, key3, key4, key5, key6, data FROM test_table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var key1, keyid, key2, key3, key4, key5, key6 string
+		var data []byte
+		if err := rows.Scan(&key1, &keyid, &key2, &key3, &key4, &key5, &key6, &data); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 rows through passthrough VFS, got %d", count)
+	}
+}
+
+func TestRegisterVFSReplace(t *testing.T) {
+	name := "passthrough_test_replace"
+	dir1 := t.TempDir()
+	if err := RegisterVFS(name, &passthroughVFS{dir: dir1}); err != nil {
+		t.Fatal(err)
+	}
+
+	vfsHandlesMu.Lock()
+	handlesAfterFirst := len(vfsHandles)
+	vfsHandlesMu.Unlock()
+
+	dir2 := t.TempDir()
+	if err := RegisterVFS(name, &passthroughVFS{dir: dir2}); err != nil {
+		t.Fatal(err)
+	}
+
+	vfsHandlesMu.Lock()
+	handlesAfterSecond := len(vfsHandles)
+	vfsHandlesMu.Unlock()
+
+	if handlesAfterSecond != handlesAfterFirst {
+		t.Fatalf("re-registering %q leaked a vfsHandles entry: had %d, now %d", name, handlesAfterFirst, handlesAfterSecond)
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:test.db?vfs=%s", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	initDatabase(t, db, 10)
+
+	if _, err := os.Stat(filepath.Join(dir2, "test.db")); err != nil {
+		t.Fatalf("expected test.db to be created under the replacement VFS's dir: %v", err)
+	}
+}
+
+// TestRegisterVFSReplaceWhileOpen covers the case TestRegisterVFSReplace
+// doesn't: replacing a registration while a connection opened against the
+// old VFS is still alive and using it. The old VFS's C-side state must stay
+// alive (and usable) until that connection has closed every file it has
+// open through it, rather than being freed out from under it.
+func TestRegisterVFSReplaceWhileOpen(t *testing.T) {
+	name := "passthrough_test_replace_while_open"
+	dir1 := t.TempDir()
+	if err := RegisterVFS(name, &passthroughVFS{dir: dir1}); err != nil {
+		t.Fatal(err)
+	}
+
+	db1, err := sql.Open("sqlite3", fmt.Sprintf("file:test.db?vfs=%s", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initDatabase(t, db1, 10)
+
+	dir2 := t.TempDir()
+	if err := RegisterVFS(name, &passthroughVFS{dir: dir2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// db1's connection still has test.db open against the now-retired VFS;
+	// it must keep working rather than crash on a freed sqlite3_vfs.
+	rows, err := db1.Query("SELECT key1 FROM test_table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Fatalf("expected 10 rows through the retired VFS, got %d", count)
+	}
+	if err := db1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// db1 has now closed every file it had open through the retired VFS,
+	// so its C-side state is released. New connections under the name have
+	// used the replacement since the second RegisterVFS call.
+	db2, err := sql.Open("sqlite3", fmt.Sprintf("file:test.db?vfs=%s", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	initDatabase(t, db2, 5)
+
+	if _, err := os.Stat(filepath.Join(dir2, "test.db")); err != nil {
+		t.Fatalf("expected test.db to be created under the replacement VFS's dir: %v", err)
+	}
+}